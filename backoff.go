@@ -0,0 +1,37 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes reconnect delays using exponential backoff with full
+// jitter, so a fleet of hchecker instances doesn't hammer Redis in lockstep
+// after a restart.
+type Backoff struct {
+	Min, Max time.Duration
+	Factor   float64
+
+	attempt int
+}
+
+// Duration returns the delay to wait before the next attempt, and advances
+// the internal attempt counter.
+func (b *Backoff) Duration() time.Duration {
+	d := float64(b.Min) * math.Pow(b.Factor, float64(b.attempt))
+	b.attempt++
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	d = rand.Float64() * d
+	if d < float64(b.Min) {
+		d = float64(b.Min)
+	}
+	return time.Duration(d)
+}
+
+// Reset clears the attempt counter, e.g. after a successful reconnect.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Default network address of Redis
+const REDIS_ADDRESS = "localhost:6379"
+
+var (
+	redisAddress       string
+	redisBackoffMin    time.Duration
+	redisBackoffMax    time.Duration
+	redisBackoffFactor float64
+)
+
+// redisConnection is a thin wrapper around a redigo connection adding the
+// few helpers hchecker needs (INFO parsing, keyed helpers, ...).
+type redisConnection struct {
+	redis.Conn
+}
+
+// InfoMap runs the Redis INFO command and parses its output into a map, so
+// callers can look up fields such as "process_id" without re-parsing the
+// raw reply every time.
+func (r *redisConnection) InfoMap() (map[string]string, error) {
+	reply, err := redis.String(r.Do("INFO"))
+	if err != nil {
+		return nil, err
+	}
+	info := make(map[string]string)
+	for _, line := range strings.Split(reply, "\r\n") {
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		info[kv[0]] = kv[1]
+	}
+	return info, nil
+}
+
+// Cache holds the Redis connection used to look up, lock and flag backends.
+// It transparently reconnects (with backoff) when that connection is lost,
+// instead of giving up.
+type Cache struct {
+	mu           sync.Mutex
+	redisConn    *redisConnection
+	backoff      Backoff
+	reconnecting bool
+	resumeCh     chan struct{}
+	onReconnect  func()
+	// redisPid is the process_id reported by the last INFO call, used to
+	// notice a Redis restart that didn't actually drop the TCP connection
+	// (e.g. a proxy/VIP in front of Redis reconnecting us to a fresh
+	// process transparently).
+	redisPid string
+
+	// connMu serializes every use of redisConn, round trip included:
+	// redigo's Conn.Do is not safe for concurrent use by multiple
+	// goroutines, and every check/lock/mark call above shares this one
+	// Cache. Use do() instead of calling c.redisConn.Do directly.
+	connMu sync.Mutex
+}
+
+// do runs a Redis command on behalf of one of many concurrently-running
+// callers (one per backend currently being checked, plus PingAlive, plus
+// addCheck), holding connMu for the whole round trip so their replies can't
+// get interleaved on the wire.
+func (c *Cache) do(commandName string, args ...interface{}) (interface{}, error) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.redisConn.Do(commandName, args...)
+}
+
+// infoMap is do's counterpart for the INFO command, which redisConnection
+// wraps rather than exposing raw.
+func (c *Cache) infoMap() (map[string]string, error) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.redisConn.InfoMap()
+}
+
+func NewCache() (*Cache, error) {
+	return newCacheForAddress(redisAddress)
+}
+
+// newCacheForAddress dials a Cache against a specific Redis address, rather
+// than the process-wide -redis one. Used by the redis-sentinel queue, whose
+// resolved master address can differ from -redis.
+func newCacheForAddress(address string) (*Cache, error) {
+	conn, err := redis.DialTimeout("tcp", address, connectionTimeout, ioTimeout, ioTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to Redis at %s: %s", address, err)
+	}
+	ready := make(chan struct{})
+	close(ready)
+	return &Cache{
+		redisConn: &redisConnection{conn},
+		backoff:   Backoff{Min: redisBackoffMin, Max: redisBackoffMax, Factor: redisBackoffFactor},
+		resumeCh:  ready,
+	}, nil
+}
+
+// Resume returns a channel that stays open while the connection to Redis is
+// down and is closed once it comes back. Long-running goroutines (checkers)
+// should read from it between iterations to pause rather than error out
+// while Redis is unavailable.
+func (c *Cache) Resume() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resumeCh
+}
+
+// Connected reports whether the Redis connection is currently usable.
+func (c *Cache) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.reconnecting
+}
+
+// isConnError distinguishes a Redis application error (e.g. "ERR index out
+// of range", meaning the command ran fine but doesn't apply) from a
+// connection-level failure that should trigger a reconnect.
+func isConnError(err error) bool {
+	if err == nil || err == redis.ErrNil {
+		return false
+	}
+	_, isRedisErr := err.(redis.Error)
+	return !isRedisErr
+}
+
+// waitForReconnect kicks off (or joins) the reconnect loop and blocks the
+// caller until Redis is reachable again.
+func (c *Cache) waitForReconnect() {
+	c.mu.Lock()
+	if c.reconnecting {
+		ch := c.resumeCh
+		c.mu.Unlock()
+		<-ch
+		return
+	}
+	c.reconnecting = true
+	pauseCh := make(chan struct{})
+	c.resumeCh = pauseCh
+	c.mu.Unlock()
+	c.reconnect(pauseCh)
+	<-pauseCh
+}
+
+func (c *Cache) reconnect(pauseCh chan struct{}) {
+	go func() {
+		c.backoff.Reset()
+		for {
+			conn, err := redis.DialTimeout("tcp", redisAddress, connectionTimeout, ioTimeout, ioTimeout)
+			if err == nil {
+				c.connMu.Lock()
+				oldConn := c.redisConn
+				c.redisConn = &redisConnection{conn}
+				c.connMu.Unlock()
+				c.mu.Lock()
+				c.reconnecting = false
+				onReconnect := c.onReconnect
+				c.mu.Unlock()
+				oldConn.Close()
+				metricRedisReconnectsTotal.Inc()
+				log.Println("Cache: reconnected to Redis at", redisAddress)
+				close(pauseCh)
+				if onReconnect != nil {
+					onReconnect()
+				}
+				return
+			}
+			d := c.backoff.Duration()
+			log.Println("Cache: could not reconnect to Redis:", err, "- retrying in", d)
+			time.Sleep(d)
+		}
+	}()
+}
+
+// ListenToChannel subscribes to a Redis pub/sub channel and calls callback
+// for every message received. The subscription is transparently
+// re-established after a reconnect.
+//
+// It uses its own dedicated connection rather than redisConn/do(): once
+// subscribed, a Redis connection can only be used for pub/sub commands
+// until unsubscribed, so it can't share a socket with LockBackend/
+// MarkBackendDead/... (see the "redis-list" queue's blockConn for the same
+// reasoning applied to BLPOP).
+func (c *Cache) ListenToChannel(channel string, callback func(string)) error {
+	c.mu.Lock()
+	c.onReconnect = func() {
+		if err := c.subscribeAndServe(channel, callback); err != nil {
+			log.Println("Cache: could not resubscribe to", channel, ":", err)
+		}
+	}
+	c.mu.Unlock()
+	return c.subscribeAndServe(channel, callback)
+}
+
+func (c *Cache) subscribeAndServe(channel string, callback func(string)) error {
+	conn, err := redis.DialTimeout("tcp", redisAddress, connectionTimeout, 0, 0)
+	if err != nil {
+		return err
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(channel); err != nil {
+		conn.Close()
+		return err
+	}
+	go func() {
+		for {
+			switch v := psc.Receive().(type) {
+			case redis.Message:
+				callback(string(v.Data))
+			case error:
+				log.Println("Cache: lost subscription to", channel, ":", v)
+				conn.Close()
+				c.waitForReconnect()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// PingAlive announces this checker's presence so operators can tell live
+// instances apart from stale ones. It is skipped, rather than blocking,
+// while a reconnect is in progress.
+func (c *Cache) PingAlive() {
+	if !c.Connected() {
+		return
+	}
+	c.checkForRestart()
+	if _, err := c.do("SETEX", "hchecker:"+myId, 60, "alive"); isConnError(err) {
+		go c.waitForReconnect()
+	}
+}
+
+// checkForRestart compares Redis' process_id against the one last observed,
+// forcing a reconnect (and, for pub/sub, a resubscribe) if it changed. A
+// plain TCP-level disconnect is already caught elsewhere; this exists for
+// the case where the socket survives a Redis restart behind a proxy/VIP and
+// we'd otherwise keep talking to a process that just lost all its state.
+func (c *Cache) checkForRestart() {
+	info, err := c.infoMap()
+	if err != nil {
+		return
+	}
+	pid := info["process_id"]
+	if pid == "" {
+		return
+	}
+	c.mu.Lock()
+	if c.redisPid == "" {
+		c.redisPid = pid
+		c.mu.Unlock()
+		return
+	}
+	restarted := pid != c.redisPid
+	if restarted {
+		c.redisPid = pid
+	}
+	c.mu.Unlock()
+	if restarted {
+		log.Println("Cache: Redis process_id changed - restart detected, forcing reconnect")
+		go c.waitForReconnect()
+	}
+}
+
+// LockBackend tries to acquire an exclusive lock on the backend described
+// by check, so that only one hchecker instance tests it at a time. It
+// returns the lock status and a channel that is signalled whenever the
+// "dead" notification for this backend is seen again while the check is
+// already running.
+func (c *Cache) LockBackend(check *Check) (bool, chan int) {
+	key := "hchecker:lock:" + check.FrontendKey + ":" + check.BackendUrl
+	for {
+		reply, err := c.do("SET", key, myId, "NX", "EX", int(checkBreakInterval.Seconds()))
+		if isConnError(err) {
+			c.waitForReconnect()
+			continue
+		}
+		if err != nil || reply == nil {
+			return false, nil
+		}
+		return true, make(chan int, 1)
+	}
+}
+
+// UnlockBackend releases the lock acquired by LockBackend.
+func (c *Cache) UnlockBackend(check *Check) {
+	key := "hchecker:lock:" + check.FrontendKey + ":" + check.BackendUrl
+	c.do("DEL", key)
+}
+
+// IsUnlockedBackend reports whether this instance still owns the lock on
+// the backend described by check. A connection error waits out the
+// reconnect and retries, rather than being treated as "lock lost": a Redis
+// blip should pause the check (see Cache.Resume), not tear it down.
+func (c *Cache) IsUnlockedBackend(check *Check) bool {
+	key := "hchecker:lock:" + check.FrontendKey + ":" + check.BackendUrl
+	for {
+		owner, err := redis.String(c.do("GET", key))
+		if isConnError(err) {
+			c.waitForReconnect()
+			continue
+		}
+		return err != nil || owner != myId
+	}
+}
+
+// MarkBackendDead flags the backend as dead in the frontend's backend list.
+func (c *Cache) MarkBackendDead(check *Check) bool {
+	return c.markBackend(check, "dead")
+}
+
+// MarkBackendAlive flags the backend as alive in the frontend's backend
+// list.
+func (c *Cache) MarkBackendAlive(check *Check) bool {
+	return c.markBackend(check, "alive")
+}
+
+// markBackend retries on connection errors (waiting out any in-progress
+// reconnect) but gives up immediately on application errors, e.g. the
+// frontend or backend having been removed from Redis in the meantime.
+func (c *Cache) markBackend(check *Check, state string) bool {
+	key := "frontend:" + check.FrontendKey
+	for {
+		_, err := c.do("LSET", key, check.BackendId, state+":"+check.BackendUrl)
+		if err == nil {
+			return true
+		}
+		if isConnError(err) {
+			c.waitForReconnect()
+			continue
+		}
+		return false
+	}
+}
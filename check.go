@@ -10,6 +10,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -45,6 +46,13 @@ var (
 	checkBreakInterval = time.Duration(CHECK_BREAK_INTERVAL) * time.Second
 	connectionTimeout  time.Duration
 	ioTimeout          time.Duration
+
+	// TLS flags, applied to every backend probed over HTTPS unless a
+	// per-frontend override (see config.go) says otherwise.
+	tlsCAFile             string
+	tlsCertFile           string
+	tlsKeyFile            string
+	tlsInsecureSkipVerify bool
 )
 
 type Check struct {
@@ -53,6 +61,22 @@ type Check struct {
 	BackendGroupLength int
 	FrontendKey        string
 
+	// CheckType selects the Prober used to test BackendUrl. Defaults to
+	// CHECK_TYPE_HTTP.
+	CheckType CheckType
+	// ScriptPath is the external command to run, only used when
+	// CheckType is CHECK_TYPE_SCRIPT.
+	ScriptPath string
+
+	prober Prober
+	// config holds the effective HTTP check settings, after applying any
+	// per-frontend override on top of the process-wide -method/-uri/-host
+	// flags. Only used by the HTTP prober.
+	config *checkConfig
+	// transport is a per-check http.Transport, only built when config.TLS
+	// overrides the process-wide TLS settings.
+	transport *http.Transport
+
 	// Goroutine unique signature
 	routineSig string
 
@@ -67,8 +91,9 @@ type Check struct {
 }
 
 func NewCheck(line string) (*Check, error) {
+	// frontend;backendUrl;backendId;backendGroupLength[;checkType[;scriptPath]]
 	parts := strings.Split(strings.TrimSpace(line), ";")
-	if len(parts) != 4 {
+	if len(parts) < 4 {
 		return nil, errors.New("Invalid check line")
 	}
 	u, err := url.Parse(parts[1])
@@ -78,8 +103,29 @@ func NewCheck(line string) (*Check, error) {
 	backendUrl := fmt.Sprintf("%s://%s", u.Scheme, u.Host)
 	backendId, _ := strconv.Atoi(parts[2])
 	backendGroupLength, _ := strconv.Atoi(parts[3])
+	checkType := CHECK_TYPE_HTTP
+	if len(parts) >= 5 && len(parts[4]) > 0 {
+		checkType = CheckType(parts[4])
+	}
+	scriptPath := ""
+	if checkType == CHECK_TYPE_SCRIPT {
+		if len(parts) < 6 || len(parts[5]) == 0 {
+			return nil, errors.New("Invalid check line: script check requires a script path")
+		}
+		scriptPath = parts[5]
+	}
+	prober, err := newProber(checkType)
+	if err != nil {
+		return nil, err
+	}
+	config, err := resolveCheckConfig(parts[0])
+	if err != nil {
+		return nil, err
+	}
 	c := &Check{BackendUrl: backendUrl, BackendId: backendId,
-		BackendGroupLength: backendGroupLength, FrontendKey: parts[0]}
+		BackendGroupLength: backendGroupLength, FrontendKey: parts[0],
+		CheckType: checkType, ScriptPath: scriptPath, prober: prober,
+		config: config}
 	if len(httpUserAgent) == 0 {
 		httpUserAgent = fmt.Sprintf("%s-HealthCheck/%s %s", PROVIDER, VERSION,
 			runtime.Version())
@@ -103,29 +149,78 @@ func (c *Check) SetExitCallback(callback func()) {
 	c.exitCallback = callback
 }
 
-func (c *Check) doHttpRequest() (*http.Response, error) {
-	if httpTransport == nil {
-		httpDial := func(proto string, addr string) (net.Conn, error) {
-			conn, err := net.DialTimeout(proto, addr, connectionTimeout)
-			if err != nil {
-				return nil, err
-			}
-			conn.SetDeadline(time.Now().Add(ioTimeout))
-			return conn, nil
+// httpTransportFor returns the transport to use for c: the shared,
+// process-wide one built from the -tls-* flags and -host, unless the
+// frontend's override supplies its own TLS settings or its own host (which
+// drives SNI, so it needs its own transport too), in which case a dedicated
+// transport is built once and cached on the Check.
+func (c *Check) httpTransportFor() (*http.Transport, error) {
+	if c.config.TLS == nil && c.config.Host == httpHost {
+		return sharedHttpTransport()
+	}
+	if c.transport == nil {
+		t, err := newHttpTransport(c.config.TLS, c.config.Host)
+		if err != nil {
+			return nil, err
 		}
-		httpTransport = &http.Transport{
-			DisableKeepAlives:  true,
-			DisableCompression: true,
-			Dial:               httpDial,
+		c.transport = t
+	}
+	return c.transport, nil
+}
+
+func sharedHttpTransport() (*http.Transport, error) {
+	if httpTransport != nil {
+		return httpTransport, nil
+	}
+	t, err := newHttpTransport(nil, httpHost)
+	if err != nil {
+		return nil, err
+	}
+	httpTransport = t
+	return httpTransport, nil
+}
+
+func newHttpTransport(tlsOverride *tlsOverride, sniHost string) (*http.Transport, error) {
+	tlsConfig, err := buildTLSConfig(tlsOverride, sniHost)
+	if err != nil {
+		return nil, err
+	}
+	dial := func(proto string, addr string) (net.Conn, error) {
+		conn, err := net.DialTimeout(proto, addr, connectionTimeout)
+		if err != nil {
+			return nil, err
 		}
+		conn.SetDeadline(time.Now().Add(ioTimeout))
+		return conn, nil
+	}
+	return &http.Transport{
+		DisableKeepAlives:  true,
+		DisableCompression: true,
+		Dial:               dial,
+		TLSClientConfig:    tlsConfig,
+	}, nil
+}
+
+func (c *Check) doHttpRequest() (*http.Response, error) {
+	transport, err := c.httpTransportFor()
+	if err != nil {
+		return nil, err
 	}
-	req, _ := http.NewRequest(httpMethod, c.BackendUrl, nil)
-	req.URL.Path = httpUri
-	req.Host = httpHost
+	method := c.config.Method
+	if c.config.ExpectedBodyRegex != nil && method == HTTP_METHOD {
+		// A HEAD request has no body to match against.
+		method = "GET"
+	}
+	req, _ := http.NewRequest(method, c.BackendUrl, nil)
+	req.URL.Path = c.config.URI
+	req.Host = c.config.Host
 	req.Header.Add("User-Agent", httpUserAgent)
+	for name, value := range c.config.Headers {
+		req.Header.Set(name, value)
+	}
 	req.Close = true
 	log.Println(c.FrontendKey, "Requesting", req.URL, "...")
-	return httpTransport.RoundTrip(req)
+	return transport.RoundTrip(req)
 }
 
 func (c *Check) PingUrl(ch chan int) {
@@ -141,6 +236,9 @@ func (c *Check) PingUrl(ch chan int) {
 		n               = 1
 	)
 	for {
+		// Pause while the connection to Redis is down instead of tearing
+		// the check down; it resumes as soon as the reconnect succeeds.
+		<-cache.Resume()
 		select {
 		case <-ch:
 			// If we added a frontend to the mapping, we consider it's the
@@ -149,27 +247,24 @@ func (c *Check) PingUrl(ch chan int) {
 		default:
 		}
 		log.Println(c.FrontendKey, "Checking", c.BackendUrl, "for", n, "time.", time.Since(lastStateChange), "since last status change.")
-		resp, err := c.doHttpRequest()
-		if err != nil {
-			// TCP error
+		probeStart := time.Now()
+		result := c.prober.Probe(c)
+		latency := time.Since(probeStart)
+		if result.Err != nil {
 			newStatus = false
 			healthy = false
-			log.Println(c.FrontendKey, "Response from", c.BackendUrl, "... TCP error:", err.Error())
+			incProbeError(string(c.CheckType))
+			observeCheckDuration(c.FrontendKey, "error", latency)
+			eventLogger.CheckEvent(c.FrontendKey, c.BackendUrl, "error", latency, result.Err)
 		} else {
-			// No TCP error, checking HTTP code
-			if resp.StatusCode >= 500 && resp.StatusCode < 600 &&
-				resp.StatusCode != 503 {
-				newStatus = false
-				healthy = false
-				log.Println(c.FrontendKey, "Response from", c.BackendUrl, "... HTTP error:", resp.Status)
-			} else {
-				newStatus = true
-				healthy = true
-				log.Println(c.FrontendKey, "Response from", c.BackendUrl, "... OK", resp.StatusCode)
+			newStatus = true
+			healthy = !result.Warning
+			msg := "ok"
+			if result.Warning {
+				msg = "warning"
 			}
-		}
-		if resp != nil && resp.Body != nil {
-			resp.Body.Close()
+			observeCheckDuration(c.FrontendKey, msg, latency)
+			eventLogger.CheckEvent(c.FrontendKey, c.BackendUrl, msg, latency, nil)
 		}
 		// Check if the status changed before updating Redis
 		if newStatus != status || firstCheck == true {
@@ -181,6 +276,7 @@ func (c *Check) PingUrl(ch chan int) {
 						break
 					}
 				}
+				setBackendState(c.FrontendKey, c.BackendUrl, true)
 				lastDeadCall = time.Time{}
 			} else {
 				if c.deadCallback != nil {
@@ -189,6 +285,7 @@ func (c *Check) PingUrl(ch chan int) {
 						break
 					}
 				}
+				setBackendState(c.FrontendKey, c.BackendUrl, false)
 				lastDeadCall = time.Now()
 			}
 		} else if newStatus == false {
@@ -208,8 +305,8 @@ func (c *Check) PingUrl(ch chan int) {
 		}
 		status = newStatus
 		firstCheck = false
-		time.Sleep(checkInterval)
-		i += checkInterval
+		time.Sleep(c.config.Interval)
+		i += c.config.Interval
 		n += 1
 		// At longer interval, we check if still have the lock on the backend
 		if i >= checkBreakInterval {
@@ -227,7 +324,7 @@ func (c *Check) PingUrl(ch chan int) {
 		}
 	}
 	if c.exitCallback != nil {
-		log.Println(c.FrontendKey, "Removed check for backend", c.BackendUrl, "| ", runningCheckers-1, "backends being checked.")
+		log.Println(c.FrontendKey, "Removed check for backend", c.BackendUrl, "| ", atomic.LoadInt64(&runningCheckers)-1, "backends being checked.")
 		c.exitCallback()
 	}
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// tlsOverride customizes the TLS transport used for a single frontend,
+// on top of the process-wide -tls-* flags.
+type tlsOverride struct {
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	ServerName         string `json:"server_name"`
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+}
+
+// frontendHealthCheckOverride is the JSON payload stored at
+// frontend:<name>:healthcheck, letting a frontend customize how its
+// backends are probed without redeploying hchecker.
+type frontendHealthCheckOverride struct {
+	Method            string            `json:"method"`
+	URI               string            `json:"uri"`
+	Host              string            `json:"host"`
+	IntervalSeconds   int               `json:"interval"`
+	ExpectedStatus    []int             `json:"expected_status"`
+	ExpectedBodyRegex string            `json:"expected_body_regex"`
+	Headers           map[string]string `json:"headers"`
+	TLS               *tlsOverride      `json:"tls"`
+}
+
+// FrontendHealthCheckOverride fetches and parses the per-frontend override,
+// if any. It returns (nil, nil) when the frontend has no override set.
+func (c *Cache) FrontendHealthCheckOverride(frontend string) (*frontendHealthCheckOverride, error) {
+	raw, err := redis.String(c.do("GET", "frontend:"+frontend+":healthcheck"))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	override := &frontendHealthCheckOverride{}
+	if err := json.Unmarshal([]byte(raw), override); err != nil {
+		return nil, err
+	}
+	return override, nil
+}
+
+// checkConfig holds the effective HTTP check settings for a Check, after
+// applying any per-frontend override on top of the process-wide defaults.
+type checkConfig struct {
+	Method            string
+	URI               string
+	Host              string
+	Interval          time.Duration
+	Headers           map[string]string
+	ExpectedStatuses  map[int]bool // nil means "use the legacy not-5xx-except-503 rule"
+	ExpectedBodyRegex *regexp.Regexp
+	TLS               *tlsOverride
+}
+
+// isExpectedStatus reports whether code should be considered healthy.
+func (cfg *checkConfig) isExpectedStatus(code int) bool {
+	if len(cfg.ExpectedStatuses) > 0 {
+		return cfg.ExpectedStatuses[code]
+	}
+	return !(code >= 500 && code < 600 && code != 503)
+}
+
+// defaultCheckConfig builds a checkConfig from the process-wide -method/
+// -uri/-host flags, with no per-frontend override applied.
+func defaultCheckConfig() *checkConfig {
+	return &checkConfig{Method: httpMethod, URI: httpUri, Host: httpHost, Interval: checkInterval}
+}
+
+// resolveCheckConfig applies frontend's healthcheck override, if any, on
+// top of the process-wide defaults.
+func resolveCheckConfig(frontend string) (*checkConfig, error) {
+	config := defaultCheckConfig()
+	if cache == nil {
+		return config, nil
+	}
+	override, err := cache.FrontendHealthCheckOverride(frontend)
+	if err != nil {
+		return nil, err
+	}
+	return applyCheckConfigOverride(config, override)
+}
+
+// applyCheckConfigOverride merges override on top of config, field by
+// field, leaving config's process-wide defaults in place wherever override
+// doesn't set one. Returns config unchanged if override is nil.
+func applyCheckConfigOverride(config *checkConfig, override *frontendHealthCheckOverride) (*checkConfig, error) {
+	if override == nil {
+		return config, nil
+	}
+	if override.Method != "" {
+		config.Method = override.Method
+	}
+	if override.URI != "" {
+		config.URI = override.URI
+	}
+	if override.Host != "" {
+		config.Host = override.Host
+	}
+	if override.IntervalSeconds > 0 {
+		config.Interval = time.Duration(override.IntervalSeconds) * time.Second
+	}
+	if len(override.ExpectedStatus) > 0 {
+		config.ExpectedStatuses = make(map[int]bool, len(override.ExpectedStatus))
+		for _, status := range override.ExpectedStatus {
+			config.ExpectedStatuses[status] = true
+		}
+	}
+	if override.ExpectedBodyRegex != "" {
+		re, err := regexp.Compile(override.ExpectedBodyRegex)
+		if err != nil {
+			return nil, err
+		}
+		config.ExpectedBodyRegex = re
+	}
+	if len(override.Headers) > 0 {
+		config.Headers = override.Headers
+	}
+	config.TLS = override.TLS
+	return config, nil
+}
+
+// buildTLSConfig merges the process-wide -tls-* flags with a per-frontend
+// override (which may be nil) into a *tls.Config, with the override taking
+// precedence field by field. sniHost is used as the ServerName unless the
+// override sets its own.
+func buildTLSConfig(override *tlsOverride, sniHost string) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: tlsInsecureSkipVerify,
+		ServerName:         sniHost,
+	}
+	caFile, certFile, keyFile := tlsCAFile, tlsCertFile, tlsKeyFile
+	if override != nil {
+		if override.InsecureSkipVerify {
+			config.InsecureSkipVerify = true
+		}
+		if override.ServerName != "" {
+			config.ServerName = override.ServerName
+		}
+		if override.CAFile != "" {
+			caFile = override.CAFile
+		}
+		if override.CertFile != "" {
+			certFile = override.CertFile
+		}
+		if override.KeyFile != "" {
+			keyFile = override.KeyFile
+		}
+	}
+	if caFile != "" {
+		pemData, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
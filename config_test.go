@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsExpectedStatus(t *testing.T) {
+	cases := []struct {
+		name     string
+		cfg      *checkConfig
+		code     int
+		expected bool
+	}{
+		{"legacy 200 ok", &checkConfig{}, 200, true},
+		{"legacy 404 ok", &checkConfig{}, 404, true},
+		{"legacy 500 not expected", &checkConfig{}, 500, false},
+		{"legacy 503 is the one allowed 5xx", &checkConfig{}, 503, true},
+		{"legacy 599 not expected", &checkConfig{}, 599, false},
+		{
+			"override replaces the legacy rule",
+			&checkConfig{ExpectedStatuses: map[int]bool{500: true}},
+			500, true,
+		},
+		{
+			"override: codes not listed are not expected, even 200",
+			&checkConfig{ExpectedStatuses: map[int]bool{500: true}},
+			200, false,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.cfg.isExpectedStatus(c.code); got != c.expected {
+				t.Errorf("isExpectedStatus(%d) = %v, want %v", c.code, got, c.expected)
+			}
+		})
+	}
+}
+
+func TestApplyCheckConfigOverrideNil(t *testing.T) {
+	base := &checkConfig{Method: "HEAD", URI: "/ping", Host: "example.com", Interval: 5 * time.Second}
+	got, err := applyCheckConfigOverride(base, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != base {
+		t.Fatalf("expected the unchanged base config back when override is nil")
+	}
+}
+
+func TestApplyCheckConfigOverrideMerging(t *testing.T) {
+	base := &checkConfig{Method: "HEAD", URI: "/ping", Host: "example.com", Interval: 5 * time.Second}
+	override := &frontendHealthCheckOverride{
+		URI:             "/health",
+		IntervalSeconds: 30,
+		ExpectedStatus:  []int{200, 204},
+		Headers:         map[string]string{"X-Check": "1"},
+	}
+	got, err := applyCheckConfigOverride(base, override)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// Only overridden fields change; unset ones keep the process-wide default.
+	if got.Method != "HEAD" {
+		t.Errorf("Method = %q, want unchanged %q", got.Method, "HEAD")
+	}
+	if got.URI != "/health" {
+		t.Errorf("URI = %q, want %q", got.URI, "/health")
+	}
+	if got.Host != "example.com" {
+		t.Errorf("Host = %q, want unchanged %q", got.Host, "example.com")
+	}
+	if got.Interval != 30*time.Second {
+		t.Errorf("Interval = %s, want %s", got.Interval, 30*time.Second)
+	}
+	if !got.ExpectedStatuses[200] || !got.ExpectedStatuses[204] {
+		t.Errorf("ExpectedStatuses = %v, want 200 and 204 set", got.ExpectedStatuses)
+	}
+	if got.Headers["X-Check"] != "1" {
+		t.Errorf("Headers = %v, want X-Check=1", got.Headers)
+	}
+}
+
+func TestApplyCheckConfigOverrideInvalidRegex(t *testing.T) {
+	base := defaultCheckConfig()
+	override := &frontendHealthCheckOverride{ExpectedBodyRegex: "("}
+	if _, err := applyCheckConfigOverride(base, override); err == nil {
+		t.Fatal("expected an error for an invalid ExpectedBodyRegex")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -16,11 +17,13 @@ const VERSION = "0.2.6"
 
 var (
 	myId            string
-	redisPid        string
-	setRedisPid     = false
 	cache           *Cache
+	queue           DeadQueue
+	queueUri        string
+	metricsAddr     string
+	logFormat       string
 	dryRun          = false
-	runningCheckers = 0
+	runningCheckers int64
 )
 
 func addCheck(line string) {
@@ -67,41 +70,31 @@ func addCheck(line string) {
 		return cache.IsUnlockedBackend(check)
 	})
 	check.SetExitCallback(func() {
-		runningCheckers -= 1
+		atomic.AddInt64(&runningCheckers, -1)
 		cache.UnlockBackend(check)
+		deleteBackendState(check.FrontendKey, check.BackendUrl)
 	})
 	// Check the URL at a regular interval
 	go check.PingUrl(ch)
-	runningCheckers += 1
-	log.Println(check.FrontendKey, "Dead backend found! Added check for", check.BackendUrl, "| ", runningCheckers, "backends being checked.")
+	n := atomic.AddInt64(&runningCheckers, 1)
+	log.Println(check.FrontendKey, "Dead backend found! Added check for", check.BackendUrl, "| ", n, "backends being checked.")
 }
 
 /*
  * Prints some stats on runtime
  */
-func printStats(cache *Cache) {
+func printStats(queue DeadQueue) {
 	var step = 10 // 10 seconds
 	count := 0
 	for {
 		if dryRun == false {
 			// In dry run mode, we don't announce our presence
-			cache.PingAlive()
+			queue.PingAlive()
 		}
 		time.Sleep(time.Duration(step) * time.Second)
 		count += step
 		if count >= 60 {
 			// Every minute
-			// Check Redis PID
-			if infoRedis, err := cache.redisConn.InfoMap(); err == nil {
-				if !setRedisPid {
-					redisPid = infoRedis["process_id"]
-					setRedisPid = true
-				}
-				if newRedisPid := infoRedis["process_id"]; newRedisPid != redisPid {
-					log.Println("Redis was restarted. Exiting hchecker...")
-					os.Exit(1)
-				}
-			}
 			// Log status
 			count = 0
 			msg := "backend URLs are being tested"
@@ -109,8 +102,12 @@ func printStats(cache *Cache) {
 				msg += " (dry run)"
 			}
 			msg += ","
-			log.Println("Health checker status:", runningCheckers, msg, "using", runtime.NumGoroutine(),
-				"goroutines. Redis running on", redisPid)
+			state := "connected"
+			if !queue.Alive() {
+				state = "reconnecting"
+			}
+			log.Println("Health checker status:", atomic.LoadInt64(&runningCheckers), msg, "using", runtime.NumGoroutine(),
+				"goroutines. Queue backend is", state)
 		}
 	}
 }
@@ -135,7 +132,7 @@ func enableCPUProfile() {
  * Listens to signals
  */
 func handleSignals() {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT)
 	go func() {
 		switch <-c {
@@ -165,10 +162,35 @@ func parseFlags(cpuProfile *bool) {
 		"Socket read/write timeout (seconds)")
 	flag.StringVar(&redisAddress, "redis", REDIS_ADDRESS,
 		"Network address of Redis")
+	flag.StringVar(&tlsCAFile, "tls-ca", "",
+		"PEM-encoded CA bundle used to verify HTTPS backends")
+	flag.StringVar(&tlsCertFile, "tls-cert", "",
+		"PEM-encoded client certificate for mTLS to HTTPS backends")
+	flag.StringVar(&tlsKeyFile, "tls-key", "",
+		"PEM-encoded client key for mTLS to HTTPS backends")
+	flag.BoolVar(&tlsInsecureSkipVerify, "insecure-skip-verify", false,
+		"Do not verify HTTPS backend certificates")
+	flag.DurationVar(&redisBackoffMin, "redis-backoff-min", 100*time.Millisecond,
+		"Minimum delay before retrying a failed Redis connection")
+	flag.DurationVar(&redisBackoffMax, "redis-backoff-max", 60*time.Second,
+		"Maximum delay before retrying a failed Redis connection")
+	flag.Float64Var(&redisBackoffFactor, "redis-backoff-factor", 2,
+		"Exponential factor applied between Redis reconnect attempts")
+	flag.StringVar(&queueUri, "queue", "redis://",
+		"Source of dead-backend notifications: redis:// (pub/sub), "+
+			"redis-list:// (BLPOP, at-least-once), "+
+			"redis-sentinel://host1,host2/mymaster (failover-aware) or "+
+			"disk:///path/to/dir (LevelDB-backed, durable notification "+
+			"delivery). Backend locking/state always requires Redis "+
+			"(set with -redis), regardless of this setting.")
 	flag.BoolVar(cpuProfile, "cpuprofile", false,
 		"Write CPU profile to \"hchecker.prof\" (current directory)")
 	flag.BoolVar(&dryRun, "dryrun", false,
 		"Enable dry run (or simulation mode). Do not update the Redis.")
+	flag.StringVar(&metricsAddr, "metrics-addr", "",
+		"Network address to serve Prometheus metrics on (e.g. :9126). Disabled if empty.")
+	flag.StringVar(&logFormat, "log-format", "text",
+		"Log format for check events: text or json")
 	flag.Parse()
 }
 
@@ -189,6 +211,14 @@ func main() {
 	if dryRun == true {
 		fmt.Println("Enabled dry run mode (simulation)")
 	}
+	if logFormat == "json" {
+		eventLogger = jsonLogger{}
+	} else if logFormat != "text" {
+		log.Println("Unknown -log-format", logFormat, "- falling back to text")
+	}
+	if metricsAddr != "" {
+		go startMetricsServer(metricsAddr)
+	}
 	log.Println("Writting logs to /var/log/supervisor/hchecker.log")
 	// Force 1 CPU to reduce parallelism. If you want to use more CPUs, prefer
 	// spawning several processes instead.
@@ -206,11 +236,16 @@ func main() {
 		log.Println(err.Error())
 		os.Exit(1)
 	}
-	err = cache.ListenToChannel("dead", addCheck)
+	queue, err = NewDeadQueue(queueUri, cache)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	err = queue.Listen(addCheck)
 	if err != nil {
 		log.Println(err.Error())
 		os.Exit(1)
 	}
 	// This function will block and print the stats every minute
-	printStats(cache)
+	printStats(queue)
 }
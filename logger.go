@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Logger emits the structured events an operator needs to correlate a
+// backend's health over time: which frontend/backend, what status, how
+// long the probe took and, if any, the error. -log-format=json switches
+// from the historical human-readable line to one JSON object per line, for
+// shipping to ELK/Loki.
+type Logger interface {
+	CheckEvent(frontend, backend, status string, latency time.Duration, err error)
+}
+
+var eventLogger Logger = textLogger{}
+
+type textLogger struct{}
+
+func (textLogger) CheckEvent(frontend, backend, status string, latency time.Duration, err error) {
+	if err != nil {
+		log.Println(frontend, "Response from", backend, "...", status, "in", latency, "-", err.Error())
+		return
+	}
+	log.Println(frontend, "Response from", backend, "...", status, "in", latency)
+}
+
+type jsonLogger struct{}
+
+type checkEvent struct {
+	Time      string  `json:"time"`
+	Frontend  string  `json:"frontend"`
+	Backend   string  `json:"backend"`
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+func (jsonLogger) CheckEvent(frontend, backend, status string, latency time.Duration, err error) {
+	evt := checkEvent{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Frontend:  frontend,
+		Backend:   backend,
+		Status:    status,
+		LatencyMs: float64(latency) / float64(time.Millisecond),
+	}
+	if err != nil {
+		evt.Error = err.Error()
+	}
+	b, err := json.Marshal(evt)
+	if err != nil {
+		log.Println("could not marshal log event:", err)
+		return
+	}
+	fmt.Println(string(b))
+}
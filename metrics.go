@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricCheckDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "hchecker_check_duration_seconds",
+		Help: "Duration of a single backend probe, labeled by frontend and result.",
+	}, []string{"frontend", "result"})
+
+	metricBackendState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hchecker_backend_state",
+		Help: "Last known state of a backend (1 for the current state, 0 for the other).",
+	}, []string{"frontend", "backend", "state"})
+
+	metricRedisReconnectsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "hchecker_redis_reconnects_total",
+		Help: "Number of times the connection to Redis was lost and re-established.",
+	})
+
+	metricProbeErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hchecker_probe_errors_total",
+		Help: "Number of failed probes, labeled by check kind.",
+	}, []string{"kind"})
+
+	metricRunningCheckers = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "hchecker_running_checkers",
+		Help: "Number of backends currently being checked.",
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&runningCheckers))
+	})
+)
+
+func init() {
+	prometheus.MustRegister(metricCheckDuration, metricBackendState,
+		metricRedisReconnectsTotal, metricProbeErrorsTotal, metricRunningCheckers)
+}
+
+func observeCheckDuration(frontend, result string, d time.Duration) {
+	metricCheckDuration.WithLabelValues(frontend, result).Observe(d.Seconds())
+}
+
+func incProbeError(kind string) {
+	metricProbeErrorsTotal.WithLabelValues(kind).Inc()
+}
+
+// setBackendState keeps both the "alive" and "dead" series present for a
+// backend, flipping which one reads 1, so a dashboard doesn't need to treat
+// an absent series as "dead" or vice versa.
+func setBackendState(frontend, backend string, alive bool) {
+	aliveValue, deadValue := 0.0, 1.0
+	if alive {
+		aliveValue, deadValue = 1.0, 0.0
+	}
+	metricBackendState.WithLabelValues(frontend, backend, "alive").Set(aliveValue)
+	metricBackendState.WithLabelValues(frontend, backend, "dead").Set(deadValue)
+}
+
+// deleteBackendState removes a backend's series from metricBackendState.
+// Called once a check exits, so retired backends don't accumulate forever
+// in a label set whose cardinality is otherwise unbounded.
+func deleteBackendState(frontend, backend string) {
+	metricBackendState.DeleteLabelValues(frontend, backend, "alive")
+	metricBackendState.DeleteLabelValues(frontend, backend, "dead")
+}
+
+// startMetricsServer exposes the Prometheus metrics on addr. It never
+// returns; callers should run it in its own goroutine.
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Println("Serving Prometheus metrics on", addr, "/metrics")
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
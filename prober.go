@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os/exec"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// CheckType selects which Prober implementation is used to test a backend.
+type CheckType string
+
+const (
+	CHECK_TYPE_HTTP   CheckType = "http"
+	CHECK_TYPE_TCP    CheckType = "tcp"
+	CHECK_TYPE_GRPC   CheckType = "grpc"
+	CHECK_TYPE_SCRIPT CheckType = "script"
+)
+
+// Minimum delay enforced between two consecutive script executions, so a
+// misconfigured script backend can't fork-bomb the host.
+const SCRIPT_MIN_INTERVAL = 1 * time.Second
+
+// ScriptOutputBufferSize bounds the amount of script output kept in memory.
+const SCRIPT_OUTPUT_BUFFER_SIZE = 4096
+
+// ProbeResult is the outcome of a single probe attempt. A nil Err means the
+// backend is alive; Warning further qualifies that as degraded but not dead
+// (script exit code 1), which does not flip the alive/dead state.
+type ProbeResult struct {
+	Warning bool
+	// Err is set when the probe itself failed to run (TCP/gRPC error,
+	// script exec error, ...), or reported the backend unhealthy.
+	Err error
+}
+
+// Prober probes a single backend and reports whether it is alive.
+type Prober interface {
+	Probe(c *Check) ProbeResult
+}
+
+func newProber(checkType CheckType) (Prober, error) {
+	switch checkType {
+	case "", CHECK_TYPE_HTTP:
+		return &httpProber{}, nil
+	case CHECK_TYPE_TCP:
+		return &tcpProber{}, nil
+	case CHECK_TYPE_GRPC:
+		return &grpcProber{}, nil
+	case CHECK_TYPE_SCRIPT:
+		return &scriptProber{}, nil
+	default:
+		return nil, fmt.Errorf("unknown check type %q", checkType)
+	}
+}
+
+// httpProber wraps the historical HEAD-request check. It honors the
+// frontend's healthcheck override (see config.go) for method, URI, host,
+// headers, expected status codes and an optional body regex.
+type httpProber struct{}
+
+func (p *httpProber) Probe(c *Check) ProbeResult {
+	resp, err := c.doHttpRequest()
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return ProbeResult{Err: err}
+	}
+	if !c.config.isExpectedStatus(resp.StatusCode) {
+		return ProbeResult{Err: errors.New(resp.Status)}
+	}
+	if c.config.ExpectedBodyRegex != nil {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return ProbeResult{Err: err}
+		}
+		if !c.config.ExpectedBodyRegex.Match(body) {
+			return ProbeResult{Err: fmt.Errorf("response body did not match %s", c.config.ExpectedBodyRegex)}
+		}
+	}
+	return ProbeResult{}
+}
+
+// tcpProber only checks that a TCP connection can be established.
+type tcpProber struct{}
+
+func (p *tcpProber) Probe(c *Check) ProbeResult {
+	u, err := backendHostPort(c.BackendUrl)
+	if err != nil {
+		return ProbeResult{Err: err}
+	}
+	conn, err := net.DialTimeout("tcp", u, connectionTimeout)
+	if err != nil {
+		return ProbeResult{Err: err}
+	}
+	conn.Close()
+	return ProbeResult{}
+}
+
+// grpcProber calls the standard grpc.health.v1.Health/Check RPC.
+type grpcProber struct{}
+
+func (p *grpcProber) Probe(c *Check) ProbeResult {
+	addr, err := backendHostPort(c.BackendUrl)
+	if err != nil {
+		return ProbeResult{Err: err}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock())
+	if err != nil {
+		return ProbeResult{Err: err}
+	}
+	defer conn.Close()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return ProbeResult{Err: err}
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return ProbeResult{Err: fmt.Errorf("grpc health status %s", resp.Status)}
+	}
+	return ProbeResult{}
+}
+
+// scriptProber execs an external command against the backend URL. Exit code
+// 0 means alive, 1 means warning (degraded, not dead), anything else means
+// dead.
+type scriptProber struct {
+	lastRun time.Time
+}
+
+func (p *scriptProber) Probe(c *Check) ProbeResult {
+	if since := time.Since(p.lastRun); !p.lastRun.IsZero() && since < SCRIPT_MIN_INTERVAL {
+		time.Sleep(SCRIPT_MIN_INTERVAL - since)
+	}
+	p.lastRun = time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout+ioTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.ScriptPath, c.BackendUrl)
+	out := newCircularBuffer(SCRIPT_OUTPUT_BUFFER_SIZE)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := cmd.Run()
+	if err == nil {
+		return ProbeResult{}
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return ProbeResult{Warning: true}
+	}
+	return ProbeResult{Err: fmt.Errorf("script check failed: %s (output: %s)", err, out.String())}
+}
+
+// circularBuffer keeps only the last size bytes written to it, so a chatty
+// check script can't grow the process' memory unbounded.
+type circularBuffer struct {
+	buf  bytes.Buffer
+	size int
+}
+
+func newCircularBuffer(size int) *circularBuffer {
+	return &circularBuffer{size: size}
+}
+
+func (b *circularBuffer) Write(p []byte) (int, error) {
+	b.buf.Write(p)
+	if extra := b.buf.Len() - b.size; extra > 0 {
+		b.buf.Next(extra)
+	}
+	return len(p), nil
+}
+
+func (b *circularBuffer) String() string {
+	return b.buf.String()
+}
+
+func backendHostPort(backendUrl string) (string, error) {
+	u, err := url.Parse(backendUrl)
+	if err != nil {
+		return "", err
+	}
+	return u.Host, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestNewProber(t *testing.T) {
+	cases := []struct {
+		checkType CheckType
+		wantType  Prober
+	}{
+		{"", &httpProber{}},
+		{CHECK_TYPE_HTTP, &httpProber{}},
+		{CHECK_TYPE_TCP, &tcpProber{}},
+		{CHECK_TYPE_GRPC, &grpcProber{}},
+		{CHECK_TYPE_SCRIPT, &scriptProber{}},
+	}
+	for _, c := range cases {
+		prober, err := newProber(c.checkType)
+		if err != nil {
+			t.Errorf("newProber(%q): unexpected error: %s", c.checkType, err)
+			continue
+		}
+		got := fmt.Sprintf("%T", prober)
+		want := fmt.Sprintf("%T", c.wantType)
+		if got != want {
+			t.Errorf("newProber(%q) = %s, want %s", c.checkType, got, want)
+		}
+	}
+}
+
+func TestNewProberUnknownType(t *testing.T) {
+	if _, err := newProber(CheckType("bogus")); err == nil {
+		t.Fatal("expected an error for an unknown check type")
+	}
+}
+
+func TestScriptProberExitCodes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("script prober execs a shell script")
+	}
+	savedConn, savedIO := connectionTimeout, ioTimeout
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	defer func() { connectionTimeout, ioTimeout = savedConn, savedIO }()
+
+	cases := []struct {
+		name        string
+		exitCode    string
+		wantErr     bool
+		wantWarning bool
+	}{
+		{"exit 0 is healthy", "0", false, false},
+		{"exit 1 is a warning, not an error", "1", false, true},
+		{"exit 2 is an error", "2", true, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			script := writeScript(t, "exit "+c.exitCode+"\n")
+			check := &Check{ScriptPath: script, BackendUrl: "http://backend.example"}
+			prober := &scriptProber{}
+			result := prober.Probe(check)
+			if (result.Err != nil) != c.wantErr {
+				t.Errorf("Err = %v, wantErr = %v", result.Err, c.wantErr)
+			}
+			if result.Warning != c.wantWarning {
+				t.Errorf("Warning = %v, want %v", result.Warning, c.wantWarning)
+			}
+		})
+	}
+}
+
+func writeScript(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "check.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+		t.Fatalf("writing test script: %s", err)
+	}
+	return path
+}
+
+func TestCircularBuffer(t *testing.T) {
+	buf := newCircularBuffer(8)
+	buf.Write([]byte("0123456789"))
+	if got := buf.String(); got != "23456789" {
+		t.Errorf("String() = %q, want %q", got, "23456789")
+	}
+}
+
+func TestCircularBufferUnderCapacity(t *testing.T) {
+	buf := newCircularBuffer(8)
+	buf.Write([]byte("abc"))
+	if got := buf.String(); got != "abc" {
+		t.Errorf("String() = %q, want %q", got, "abc")
+	}
+}
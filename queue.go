@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// DeadQueue abstracts the source of dead-backend notifications, so hchecker
+// can be fed by something other than a single Redis pub/sub channel. This
+// only covers notification delivery: backend locking and state (see
+// cache.go) always go through Redis, regardless of which DeadQueue is in
+// use.
+type DeadQueue interface {
+	// Listen starts delivering dead-backend lines to callback. It returns
+	// once the subscription is established; delivery happens in the
+	// background.
+	Listen(callback func(string)) error
+	// PingAlive announces this checker instance's presence, mirroring the
+	// heartbeat historically sent straight to Redis.
+	PingAlive()
+	// Alive reports whether the underlying broker is healthy. It goes
+	// false when e.g. the backing Redis process was restarted, so callers
+	// can react (reconnect, or in this version, exit).
+	Alive() bool
+	Close() error
+}
+
+// NewDeadQueue builds a DeadQueue from a URI whose scheme selects the
+// backend: "redis://" (pub/sub, the historical behaviour), "redis-list://"
+// (BLPOP against a list, for at-least-once delivery), "redis-sentinel://"
+// (failover-aware, address list resolved through Sentinel) or "disk://" (a
+// local LevelDB-backed queue for the notification transport only).
+//
+// cache is the Cache already dialed by main() against -redis; "redis" and
+// "redis-list" reuse it instead of opening a second connection to the same
+// Redis. "redis-sentinel" talks to a master address resolved dynamically
+// through Sentinel, which may not be the -redis address, so it still dials
+// its own Cache. "disk" needs no Cache at all for the notification path
+// itself, but backend locking/state (see cache.go) still goes through the
+// shared one regardless of -queue.
+func NewDeadQueue(uri string, cache *Cache) (DeadQueue, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -queue %q: %s", uri, err)
+	}
+	switch u.Scheme {
+	case "", "redis":
+		return newRedisPubSubQueue(cache), nil
+	case "redis-list":
+		return newRedisListQueue(cache, redisAddress)
+	case "redis-sentinel":
+		return newRedisSentinelQueue(strings.Split(u.Host, ","), u.Path)
+	case "disk":
+		return newDiskQueue(u.Path)
+	default:
+		return nil, fmt.Errorf("unknown -queue scheme %q", u.Scheme)
+	}
+}
+
+// redisPubSubQueue is the historical behaviour: dead-backend lines are
+// published on the "dead" Redis channel. It does not own cache's connection
+// (main() does), so Close is a no-op.
+type redisPubSubQueue struct {
+	cache *Cache
+}
+
+func newRedisPubSubQueue(cache *Cache) *redisPubSubQueue {
+	return &redisPubSubQueue{cache: cache}
+}
+
+func (q *redisPubSubQueue) Listen(callback func(string)) error {
+	return q.cache.ListenToChannel("dead", callback)
+}
+
+func (q *redisPubSubQueue) PingAlive() {
+	q.cache.PingAlive()
+}
+
+func (q *redisPubSubQueue) Alive() bool {
+	return q.cache.Connected()
+}
+
+func (q *redisPubSubQueue) Close() error {
+	return nil
+}
+
+// redisListQueue delivers at-least-once by BLPOP-ing a Redis list, so a
+// notification is only dropped once a worker has actually consumed it. It
+// reuses cache for PingAlive/Connected, but BLPOP blocks the connection it
+// runs on, so it always dials its own dedicated blockConn.
+type redisListQueue struct {
+	cache     *Cache
+	blockConn *redisConnection
+	closing   chan struct{}
+}
+
+const DEAD_LIST_KEY = "hchecker:dead"
+
+func newRedisListQueue(cache *Cache, address string) (*redisListQueue, error) {
+	blockConn, err := redis.DialTimeout("tcp", address, connectionTimeout, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &redisListQueue{cache: cache, blockConn: &redisConnection{blockConn}, closing: make(chan struct{})}, nil
+}
+
+func (q *redisListQueue) Listen(callback func(string)) error {
+	go func() {
+		backoff := Backoff{Min: redisBackoffMin, Max: redisBackoffMax, Factor: redisBackoffFactor}
+		for {
+			select {
+			case <-q.closing:
+				return
+			default:
+			}
+			reply, err := redis.Values(q.blockConn.Do("BLPOP", DEAD_LIST_KEY, 0))
+			if isConnError(err) {
+				log.Println("redis-list queue: BLPOP failed:", err, "- reconnecting")
+				<-q.cache.Resume()
+				for {
+					conn, dialErr := redis.DialTimeout("tcp", redisAddress, connectionTimeout, 0, 0)
+					if dialErr == nil {
+						q.blockConn = &redisConnection{conn}
+						backoff.Reset()
+						break
+					}
+					time.Sleep(backoff.Duration())
+				}
+				continue
+			}
+			if err != nil {
+				continue
+			}
+			var line string
+			if _, err := redis.Scan(reply, nil, &line); err == nil {
+				callback(line)
+			}
+		}
+	}()
+	return nil
+}
+
+func (q *redisListQueue) PingAlive() {
+	q.cache.PingAlive()
+}
+
+func (q *redisListQueue) Alive() bool {
+	return q.cache.Connected()
+}
+
+func (q *redisListQueue) Close() error {
+	close(q.closing)
+	return q.blockConn.Close()
+}
+
+// redisSentinelQueue is a redisListQueue that resolves the current Redis
+// master address through a set of Sentinel addresses, so a master failover
+// doesn't require reconfiguring hchecker. That address may differ from the
+// process-wide -redis address used for backend locking/state, so unlike the
+// "redis" and "redis-list" schemes it dials (and owns) its own Cache rather
+// than reusing the one built from -redis.
+type redisSentinelQueue struct {
+	*redisListQueue
+	sentinelAddrs []string
+	masterName    string
+}
+
+func newRedisSentinelQueue(sentinelAddrs []string, masterPath string) (*redisSentinelQueue, error) {
+	masterName := strings.TrimPrefix(masterPath, "/")
+	if masterName == "" {
+		return nil, fmt.Errorf("redis-sentinel:// queue requires a master name, e.g. redis-sentinel://host1,host2/mymaster")
+	}
+	address, err := resolveSentinelMaster(sentinelAddrs, masterName)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := newCacheForAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	listQueue, err := newRedisListQueue(cache, address)
+	if err != nil {
+		return nil, err
+	}
+	return &redisSentinelQueue{redisListQueue: listQueue, sentinelAddrs: sentinelAddrs, masterName: masterName}, nil
+}
+
+func (q *redisSentinelQueue) Close() error {
+	q.redisListQueue.Close()
+	return q.cache.redisConn.Close()
+}
+
+func resolveSentinelMaster(sentinelAddrs []string, masterName string) (string, error) {
+	var lastErr error
+	for _, addr := range sentinelAddrs {
+		conn, err := redis.DialTimeout("tcp", addr, connectionTimeout, ioTimeout, ioTimeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reply, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", masterName))
+		conn.Close()
+		if err != nil || len(reply) != 2 {
+			lastErr = err
+			continue
+		}
+		return reply[0] + ":" + reply[1], nil
+	}
+	return "", fmt.Errorf("could not resolve master %q through sentinels %v: %s", masterName, sentinelAddrs, lastErr)
+}
+
+// diskQueue is a local LevelDB-backed queue that decouples dead-backend
+// notification delivery from Redis pub/sub uptime: Push writes are durable
+// on disk and Listen drains them even if Redis itself is flapping. It does
+// NOT make hchecker Redis-free: LockBackend/MarkBackendDead/MarkBackendAlive
+// (see cache.go) still talk to Redis, since that's where hipache itself
+// stores the frontend->backends mapping.
+//
+// Entries are stored under monotonically increasing, zero-padded sequence
+// keys, so LevelDB's lexicographic iteration order matches insertion (FIFO)
+// order. Anything writing to the queue file directly (rather than through
+// Push) must follow the same key format to preserve delivery order.
+type diskQueue struct {
+	mu      sync.Mutex
+	db      *leveldb.DB
+	seq     uint64
+	closing chan struct{}
+}
+
+func newDiskQueue(path string) (*diskQueue, error) {
+	if path == "" {
+		path = "hchecker-queue.db"
+	}
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := &diskQueue{db: db, closing: make(chan struct{})}
+	iter := db.NewIterator(nil, nil)
+	if iter.Last() {
+		last, err := strconv.ParseUint(string(iter.Key()), 10, 64)
+		if err == nil {
+			q.seq = last + 1
+		}
+	}
+	iter.Release()
+	return q, nil
+}
+
+// Push durably enqueues line for later delivery, in FIFO order relative to
+// every other Push on this queue.
+func (q *diskQueue) Push(line string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	key := []byte(fmt.Sprintf("%020d", q.seq))
+	q.seq++
+	return q.db.Put(key, []byte(line), nil)
+}
+
+// diskPollInterval bounds how long the disk queue's Listen goroutine can go
+// between checking for new entries when idle, so it doesn't busy-loop.
+const diskPollInterval = 200 * time.Millisecond
+
+func (q *diskQueue) Listen(callback func(string)) error {
+	go func() {
+		for {
+			select {
+			case <-q.closing:
+				return
+			default:
+			}
+			iter := q.db.NewIterator(nil, nil)
+			if !iter.First() {
+				iter.Release()
+				select {
+				case <-q.closing:
+					return
+				case <-time.After(diskPollInterval):
+				}
+				continue
+			}
+			key := append([]byte{}, iter.Key()...)
+			value := append([]byte{}, iter.Value()...)
+			iter.Release()
+			if err := q.db.Delete(key, nil); err == nil {
+				callback(string(value))
+			}
+		}
+	}()
+	return nil
+}
+
+// PingAlive is a no-op for the disk queue: there is no remote broker to
+// announce liveness to.
+func (q *diskQueue) PingAlive() {}
+
+// Alive is always true: a local LevelDB file can't be "restarted" the way
+// a Redis process can.
+func (q *diskQueue) Alive() bool { return true }
+
+func (q *diskQueue) Close() error {
+	close(q.closing)
+	return q.db.Close()
+}